@@ -0,0 +1,217 @@
+// Package consul implements store.Store on top of Consul's KV store, using
+// sessions for locks and the KV ModifyIndex as the store.Store modified
+// index.
+package consul
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/wandoulabs/codis/pkg/models/store"
+)
+
+// Store is a store.Store backed by a Consul agent/cluster.
+type Store struct {
+	client *api.Client
+}
+
+// NewStore connects to the given Consul agent addresses (only the first is
+// used, matching api.Client's single-endpoint config) and returns a
+// store.Store backed by it.
+func NewStore(endpoints []string) (store.Store, error) {
+	conf := api.DefaultConfig()
+	if len(endpoints) != 0 {
+		conf.Address = endpoints[0]
+	}
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{client: client}, nil
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) Get(path string) ([]byte, int64, error) {
+	pair, _, err := s.client.KV().Get(path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+	return pair.Value, int64(pair.ModifyIndex), nil
+}
+
+func (s *Store) Put(path string, value []byte) error {
+	_, err := s.client.KV().Put(&api.KVPair{Key: path, Value: value}, nil)
+	return err
+}
+
+func (s *Store) Delete(path string) error {
+	_, err := s.client.KV().Delete(path, nil)
+	return err
+}
+
+func (s *Store) List(path string) ([]string, error) {
+	pairs, _, err := s.client.KV().List(path+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(pairs))
+	for i, pair := range pairs {
+		paths[i] = pair.Key
+	}
+	return paths, nil
+}
+
+func (s *Store) AtomicPut(path string, value []byte, expectedIndex int64) error {
+	ok, _, err := s.client.KV().CAS(&api.KVPair{Key: path, Value: value, ModifyIndex: uint64(expectedIndex)}, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrVersionConflict
+	}
+	return nil
+}
+
+// PutGuarded writes value to path in the same Consul transaction as a
+// check-index verb verifying guardPath's ModifyIndex is still guardVersion.
+func (s *Store) PutGuarded(path string, value []byte, guardPath string, guardVersion int64) error {
+	ops := api.TxnOps{
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCheckIndex, Key: guardPath, Index: uint64(guardVersion)}},
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: path, Value: value}},
+	}
+	ok, _, _, err := s.client.Txn().Apply(ops, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrStaleToken
+	}
+	return nil
+}
+
+// DeleteGuarded is PutGuarded's counterpart for Delete.
+func (s *Store) DeleteGuarded(path string, guardPath string, guardVersion int64) error {
+	ops := api.TxnOps{
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCheckIndex, Key: guardPath, Index: uint64(guardVersion)}},
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: path}},
+	}
+	ok, _, _, err := s.client.Txn().Apply(ops, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return store.ErrStaleToken
+	}
+	return nil
+}
+
+// AtomicPutGuarded combines AtomicPut's check-and-set on path with
+// PutGuarded's check-index on guardPath, in a single transaction.
+func (s *Store) AtomicPutGuarded(path string, value []byte, expectedIndex int64, guardPath string, guardVersion int64) error {
+	ops := api.TxnOps{
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCheckIndex, Key: guardPath, Index: uint64(guardVersion)}},
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: path, Value: value, Index: uint64(expectedIndex)}},
+	}
+	ok, resp, _, err := s.client.Txn().Apply(ops, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		for _, e := range resp.Errors {
+			if e.OpIndex == 0 {
+				return store.ErrStaleToken
+			}
+		}
+		return store.ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *Store) Watch(path string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	go s.watch(path, ch)
+	return ch, nil
+}
+
+func (s *Store) watch(path string, ch chan<- struct{}) {
+	defer close(ch)
+	var lastIndex uint64
+	for {
+		_, meta, err := s.client.KV().List(path+"/", &api.QueryOptions{WaitIndex: lastIndex})
+		if err != nil {
+			return
+		}
+		lastIndex = meta.LastIndex
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Store) Lock(key string, value []byte, ttl time.Duration) (store.Locker, error) {
+	opts := &api.LockOptions{
+		Key:   key,
+		Value: value,
+		SessionOpts: &api.SessionEntry{
+			TTL:      ttl.String(),
+			Behavior: api.SessionBehaviorRelease,
+		},
+	}
+	lock, err := s.client.LockOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &locker{key: key, kv: s.client.KV(), lock: lock}, nil
+}
+
+type locker struct {
+	key   string
+	kv    *api.KV
+	lock  *api.Lock
+	token int64
+}
+
+func (l *locker) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	lost, err := l.lock.Lock(stopCh)
+	if err != nil {
+		return nil, err
+	}
+	pair, _, err := l.kv.Get(l.key, nil)
+	if err != nil {
+		l.lock.Unlock()
+		return nil, err
+	}
+	if pair != nil {
+		l.token = int64(pair.ModifyIndex)
+	}
+	return lost, nil
+}
+
+// Token returns the ModifyIndex of the lock key captured at the moment this
+// Lock call succeeded, Consul's nearest analogue to a ZooKeeper sequence
+// number. A live kv.Get here instead would silently return a later holder's
+// ModifyIndex once this lock is lost, rather than the token this holder was
+// actually granted.
+func (l *locker) Token() int64 {
+	return l.token
+}
+
+func (l *locker) Unlock() error {
+	if err := l.lock.Unlock(); err != api.ErrLockNotHeld {
+		return err
+	}
+	return nil
+}
+
+// Key returns the lock's KV key, whose ModifyIndex equals Token().
+func (l *locker) Key() string {
+	return l.key
+}
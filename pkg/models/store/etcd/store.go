@@ -0,0 +1,222 @@
+// Package etcd implements store.Store on top of etcd v3, using leased keys
+// with keepalives for locks and revision numbers as the store.Store modified
+// index.
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+
+	"github.com/wandoulabs/codis/pkg/models/store"
+)
+
+// Store is a store.Store backed by an etcd v3 cluster.
+type Store struct {
+	client *clientv3.Client
+}
+
+// NewStore dials the given etcd endpoints and returns a store.Store backed
+// by them.
+func NewStore(endpoints []string) (store.Store, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{client: client}, nil
+}
+
+func (s *Store) Close() error {
+	return s.client.Close()
+}
+
+func (s *Store) Get(path string) ([]byte, int64, error) {
+	resp, err := s.client.Get(context.Background(), path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	kv := resp.Kvs[0]
+	return kv.Value, kv.ModRevision, nil
+}
+
+func (s *Store) Put(path string, value []byte) error {
+	_, err := s.client.Put(context.Background(), path, string(value))
+	return err
+}
+
+func (s *Store) Delete(path string) error {
+	_, err := s.client.Delete(context.Background(), path)
+	return err
+}
+
+func (s *Store) List(path string) ([]string, error) {
+	resp, err := s.client.Get(context.Background(), path+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(resp.Kvs))
+	for i, kv := range resp.Kvs {
+		paths[i] = string(kv.Key)
+	}
+	return paths, nil
+}
+
+func (s *Store) AtomicPut(path string, value []byte, expectedIndex int64) error {
+	cmp := clientv3.Compare(clientv3.ModRevision(path), "=", expectedIndex)
+	put := clientv3.OpPut(path, string(value))
+	resp, err := s.client.Txn(context.Background()).If(cmp).Then(put).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrVersionConflict
+	}
+	return nil
+}
+
+// PutGuarded writes value to path only if guardPath's ModRevision is still
+// guardVersion, as a single etcd transaction.
+func (s *Store) PutGuarded(path string, value []byte, guardPath string, guardVersion int64) error {
+	cmp := clientv3.Compare(clientv3.ModRevision(guardPath), "=", guardVersion)
+	put := clientv3.OpPut(path, string(value))
+	resp, err := s.client.Txn(context.Background()).If(cmp).Then(put).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrStaleToken
+	}
+	return nil
+}
+
+// DeleteGuarded is PutGuarded's counterpart for Delete.
+func (s *Store) DeleteGuarded(path string, guardPath string, guardVersion int64) error {
+	cmp := clientv3.Compare(clientv3.ModRevision(guardPath), "=", guardVersion)
+	del := clientv3.OpDelete(path)
+	resp, err := s.client.Txn(context.Background()).If(cmp).Then(del).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrStaleToken
+	}
+	return nil
+}
+
+// AtomicPutGuarded combines AtomicPut's check on path with PutGuarded's
+// check on guardPath, in a single transaction.
+func (s *Store) AtomicPutGuarded(path string, value []byte, expectedIndex int64, guardPath string, guardVersion int64) error {
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(guardPath), "=", guardVersion),
+		clientv3.Compare(clientv3.ModRevision(path), "=", expectedIndex),
+	}
+	put := clientv3.OpPut(path, string(value))
+	get := clientv3.OpGet(guardPath)
+	resp, err := s.client.Txn(context.Background()).If(cmps...).Then(put).Else(get).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		kvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(kvs) == 0 || kvs[0].ModRevision != guardVersion {
+			return store.ErrStaleToken
+		}
+		return store.ErrVersionConflict
+	}
+	return nil
+}
+
+func (s *Store) Watch(path string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	wch := s.client.Watch(context.Background(), path, clientv3.WithPrefix())
+	go func() {
+		defer close(ch)
+		for range wch {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *Store) Lock(key string, value []byte, ttl time.Duration) (store.Locker, error) {
+	session, err := concurrency.NewSession(s.client, concurrency.WithTTL(int(ttl.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	return &locker{session: session, mutex: concurrency.NewMutex(session, key), value: value}, nil
+}
+
+type locker struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+	value   []byte
+	token   int64
+	cancel  context.CancelFunc
+}
+
+func (l *locker) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := l.mutex.Lock(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := l.session.Client().Put(context.Background(), l.mutex.Key(), string(l.value), clientv3.WithLease(l.session.Lease()))
+	if err != nil {
+		cancel()
+		l.mutex.Unlock(context.Background())
+		l.session.Close()
+		return nil, err
+	}
+	// Held for the lifetime of the lock so Unlock can stop the monitoring
+	// goroutine above instead of leaking it until the process exits.
+	l.cancel = cancel
+	l.token = resp.Header.Revision
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		<-l.session.Done()
+	}()
+	return lost, nil
+}
+
+func (l *locker) Unlock() error {
+	if l.cancel == nil {
+		return nil
+	}
+	l.cancel()
+	l.cancel = nil
+	if err := l.mutex.Unlock(context.Background()); err != nil {
+		return err
+	}
+	return l.session.Close()
+}
+
+// Token returns the etcd revision the lock key was last written at, which
+// is monotonically increasing cluster-wide just like a ZooKeeper sequence
+// number.
+func (l *locker) Token() int64 {
+	return l.token
+}
+
+// Key returns the mutex's underlying key, whose ModRevision equals Token().
+func (l *locker) Key() string {
+	return l.mutex.Key()
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/wandoulabs/codis/pkg/models/store/consul"
+	"github.com/wandoulabs/codis/pkg/models/store/etcd"
+	"github.com/wandoulabs/codis/pkg/models/store/zk"
+)
+
+// NewStore resolves --store-backend/--store-endpoints into a concrete Store
+// implementation. backend is one of "zookeeper" (the default, aliased as
+// "zk"), "etcd" and "consul"; endpoints is the comma-separated address list
+// each backend's client expects.
+func NewStore(backend string, endpoints []string) (Store, error) {
+	switch backend {
+	case "", "zookeeper", "zk":
+		return zk.NewStore(endpoints)
+	case "etcd":
+		return etcd.NewStore(endpoints)
+	case "consul":
+		return consul.NewStore(endpoints)
+	default:
+		return nil, fmt.Errorf("store: unknown backend %q", backend)
+	}
+}
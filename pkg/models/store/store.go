@@ -0,0 +1,105 @@
+// Package store defines a backend-agnostic coordination interface used by
+// Topom and Proxy to keep track of the cluster topology (slots, groups,
+// proxies) and to elect a single active Topom. Concrete backends live in
+// the zk, etcd and consul subpackages; callers should depend only on the
+// Store and Locker interfaces defined here.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrClosedStore     = errors.New("use of closed store")
+	ErrVersionConflict = errors.New("version conflict")
+	ErrStaleToken      = errors.New("stale fencing token")
+)
+
+// Store is the minimal set of operations codis needs from a coordination
+// service. It is modelled after the libkv backends (Get/Put/Delete/List)
+// plus AtomicPut for compare-and-swap and Lock for leader election, so that
+// ZooKeeper, etcd and Consul can all satisfy it without leaking
+// backend-specific concepts (znodes, leases, sessions) to callers.
+type Store interface {
+	// Get returns the value stored at path along with its modifiedIndex.
+	// It returns (nil, 0, nil) if path does not exist.
+	Get(path string) ([]byte, int64, error)
+
+	// Put creates or overwrites the value at path.
+	Put(path string, value []byte) error
+
+	// Delete removes path. It is not an error if path does not exist.
+	Delete(path string) error
+
+	// List returns the full paths of the keys under path: its immediate
+	// children on ZooKeeper, every key under path/ at any depth on etcd and
+	// Consul.
+	List(path string) ([]string, error)
+
+	// AtomicPut writes value to path only if its current modifiedIndex
+	// still equals expectedIndex, returning ErrVersionConflict otherwise.
+	AtomicPut(path string, value []byte, expectedIndex int64) error
+
+	// PutGuarded writes value to path, but only as part of a single
+	// backend-native transaction that also verifies guardPath (a Locker's
+	// Key()) is still at guardVersion (its Token()). Unlike a client-side
+	// comparison against a cached token, this is checked by the backend
+	// itself at commit time, so a holder whose session already expired —
+	// but whose process has not yet noticed — cannot win a race against
+	// the newly elected leader. Returns ErrStaleToken if the guard fails.
+	PutGuarded(path string, value []byte, guardPath string, guardVersion int64) error
+
+	// DeleteGuarded is PutGuarded's counterpart for Delete.
+	DeleteGuarded(path string, guardPath string, guardVersion int64) error
+
+	// AtomicPutGuarded combines AtomicPut and PutGuarded: the transaction
+	// commits only if guardPath is still at guardVersion AND path is still
+	// at expectedIndex, returning ErrStaleToken or ErrVersionConflict for
+	// whichever guard failed (ambiguous if both did).
+	AtomicPutGuarded(path string, value []byte, expectedIndex int64, guardPath string, guardVersion int64) error
+
+	// Watch delivers a signal on the returned channel whenever path or one
+	// of its children changes. The channel is closed when the watch can no
+	// longer be maintained (e.g. on an unrecoverable session loss). On
+	// ZooKeeper only a child being created or deleted, or path itself being
+	// deleted, is signalled; a new value written to an existing child is not.
+	Watch(path string) (<-chan struct{}, error)
+
+	// Lock returns a Locker backed by the given key. value is stored
+	// alongside the lock so other processes can see who holds it; ttl
+	// bounds how long the lock may outlive a dead holder (session TTL for
+	// Consul, lease TTL for etcd). The ZooKeeper backend ignores ttl: there
+	// the bound is the session timeout fixed when the store connects.
+	Lock(key string, value []byte, ttl time.Duration) (Locker, error)
+
+	Close() error
+}
+
+// Locker abstracts the leader-election primitive each backend builds on top
+// of its native session/lease mechanism (ephemeral znodes for ZooKeeper,
+// leased keys with keepalives for etcd, sessions for Consul).
+type Locker interface {
+	// Lock blocks until the lock is acquired or stopCh is closed. The
+	// returned channel is closed when the lock is subsequently lost (e.g.
+	// session expiration), so the holder can react instead of silently
+	// continuing to act as leader.
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+
+	// Unlock releases the lock. It is a no-op if the lock is not held.
+	Unlock() error
+
+	// Token returns the fencing token granted by the most recent successful
+	// Lock call: a value that strictly increases across every lock holder
+	// for the same key, backend-wide (the znode sequence number for
+	// ZooKeeper). Callers must thread it through writes guarded by the lock
+	// so a write from a holder whose session already expired — but whose
+	// process is still running — can be rejected instead of corrupting
+	// state alongside the new leader.
+	Token() int64
+
+	// Key returns the backend path/key whose version IS the fencing token:
+	// PutGuarded/DeleteGuarded/AtomicPutGuarded verify this exact
+	// (guardPath, guardVersion) pair server-side before writing.
+	Key() string
+}
@@ -0,0 +1,332 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/models"
+)
+
+var (
+	ErrClosedTopomStore = errors.New("use of closed topom store")
+	ErrAcquireAgain     = errors.New("acquire again")
+	ErrReleaseAgain     = errors.New("release again")
+	ErrNoProtection     = errors.New("operation without lock protection")
+)
+
+// TopomStore is the view of a Store that Topom and Proxy actually use: a
+// single elected leader per cluster `name`, plus CRUD for that cluster's
+// slots, proxies and groups. It replaces the old ZkStore/ZkClient split —
+// the same struct now works unmodified against whichever backend NewStore
+// picked, selected at startup via --store-backend/--store-endpoints.
+type TopomStore struct {
+	sync.Mutex
+
+	store  Store
+	prefix string
+
+	lock    Locker
+	lockKey string
+	token   int64
+	locked  bool
+	closed  bool
+}
+
+// NewTopomStore wraps s with the path layout for the named cluster.
+func NewTopomStore(s Store, name string) *TopomStore {
+	return &TopomStore{
+		store:  s,
+		prefix: filepath.Join("/codis2", name),
+	}
+}
+
+func (s *TopomStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.store.Close()
+}
+
+func (s *TopomStore) lockPath() string {
+	return filepath.Join(s.prefix, "topom")
+}
+
+func (s *TopomStore) slotPath(slotId int) string {
+	return filepath.Join(s.prefix, "slots", fmt.Sprintf("slot-%04d", slotId))
+}
+
+func (s *TopomStore) proxyBase() string {
+	return filepath.Join(s.prefix, "proxy")
+}
+
+func (s *TopomStore) proxyPath(proxyId int) string {
+	return filepath.Join(s.prefix, "proxy", fmt.Sprintf("proxy-%04d", proxyId))
+}
+
+func (s *TopomStore) groupBase() string {
+	return filepath.Join(s.prefix, "group")
+}
+
+func (s *TopomStore) groupPath(groupId int) string {
+	return filepath.Join(s.prefix, "group", fmt.Sprintf("group-%04d", groupId))
+}
+
+// Acquire blocks until topom becomes the elected leader for this cluster,
+// returning the fencing token callers must pass to every subsequent write.
+// If the lock is later lost (e.g. the backing session expires), Acquire
+// invalidates s.locked in the background so the next write call returns
+// ErrNoProtection instead of silently racing a new leader.
+func (s *TopomStore) Acquire(topom *models.Topom) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return 0, ErrClosedTopomStore
+	}
+	if s.locked {
+		return 0, ErrAcquireAgain
+	}
+
+	lock, err := s.store.Lock(s.lockPath(), topom.Encode(), time.Minute)
+	if err != nil {
+		return 0, err
+	}
+	lost, err := lock.Lock(nil)
+	if err != nil {
+		return 0, err
+	}
+	s.lock = lock
+	s.lockKey = lock.Key()
+	s.token = lock.Token()
+	s.locked = true
+
+	go func() {
+		<-lost
+		s.Lock()
+		defer s.Unlock()
+		if s.lock == lock {
+			s.locked = false
+		}
+	}()
+
+	return s.token, nil
+}
+
+func (s *TopomStore) Release() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return ErrClosedTopomStore
+	}
+	if !s.locked {
+		return ErrReleaseAgain
+	}
+
+	if err := s.lock.Unlock(); err != nil {
+		return err
+	}
+	s.lock = nil
+	s.lockKey = ""
+	s.locked = false
+	return nil
+}
+
+// checkToken must be called with s.Mutex held. It is a cheap local
+// short-circuit against the token cached at Acquire time, rejecting an
+// obviously-wrong caller before a round trip to the backend. It is not
+// sufficient protection on its own: this process may not yet know its own
+// session has expired (a GC pause, a network partition), so every write
+// below also re-validates s.lockKey/s.token against the backend atomically
+// with the write itself via PutGuarded/DeleteGuarded/AtomicPutGuarded.
+func (s *TopomStore) checkToken(token int64) error {
+	if s.closed {
+		return ErrClosedTopomStore
+	}
+	if !s.locked {
+		return ErrNoProtection
+	}
+	if token != s.token {
+		return ErrStaleToken
+	}
+	return nil
+}
+
+func (s *TopomStore) LoadSlotMapping(slotId int) (*VersionedSlotMapping, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrClosedTopomStore
+	}
+	if !s.locked {
+		return nil, ErrNoProtection
+	}
+
+	b, version, err := s.store.Get(s.slotPath(slotId))
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		slot := &models.SlotMapping{}
+		if err := slot.Decode(b); err != nil {
+			return nil, err
+		}
+		return &VersionedSlotMapping{Slot: slot, Version: version}, nil
+	}
+	return nil, nil
+}
+
+func (s *TopomStore) SaveSlotMapping(token int64, slotId int, slot *models.SlotMapping) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.PutGuarded(s.slotPath(slotId), slot.Encode(), s.lockKey, s.token)
+}
+
+// SaveSlotMappingCAS saves slot only if the slot's modified index still
+// equals expectedVersion, returning ErrVersionConflict otherwise. Like
+// SaveSlotMapping it requires the topom lock: token must be the current
+// lock's token, and the write is rejected with ErrStaleToken once that lock
+// has been lost, so a caller that does not hold the lock cannot use it.
+func (s *TopomStore) SaveSlotMappingCAS(token int64, slotId int, slot *models.SlotMapping, expectedVersion int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.AtomicPutGuarded(s.slotPath(slotId), slot.Encode(), expectedVersion, s.lockKey, s.token)
+}
+
+func (s *TopomStore) ListProxy() ([]*VersionedProxy, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrClosedTopomStore
+	}
+	if !s.locked {
+		return nil, ErrNoProtection
+	}
+
+	paths, err := s.store.List(s.proxyBase())
+	if err != nil {
+		return nil, err
+	}
+
+	var plist []*VersionedProxy
+	for _, path := range paths {
+		b, version, err := s.store.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		p := &models.Proxy{}
+		if err := p.Decode(b); err != nil {
+			return nil, err
+		}
+		plist = append(plist, &VersionedProxy{Proxy: p, Version: version})
+	}
+	return plist, nil
+}
+
+func (s *TopomStore) CreateProxy(token int64, proxyId int, proxy *models.Proxy) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.PutGuarded(s.proxyPath(proxyId), proxy.Encode(), s.lockKey, s.token)
+}
+
+func (s *TopomStore) RemoveProxy(token int64, proxyId int) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.DeleteGuarded(s.proxyPath(proxyId), s.lockKey, s.token)
+}
+
+func (s *TopomStore) ListGroup() ([]*VersionedGroup, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrClosedTopomStore
+	}
+	if !s.locked {
+		return nil, ErrNoProtection
+	}
+
+	paths, err := s.store.List(s.groupBase())
+	if err != nil {
+		return nil, err
+	}
+
+	var glist []*VersionedGroup
+	for _, path := range paths {
+		b, version, err := s.store.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		g := &models.Group{}
+		if err := g.Decode(b); err != nil {
+			return nil, err
+		}
+		glist = append(glist, &VersionedGroup{Group: g, Version: version})
+	}
+	return glist, nil
+}
+
+func (s *TopomStore) CreateGroup(token int64, groupId int, group *models.Group) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.PutGuarded(s.groupPath(groupId), group.Encode(), s.lockKey, s.token)
+}
+
+func (s *TopomStore) UpdateGroup(token int64, groupId int, group *models.Group) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.PutGuarded(s.groupPath(groupId), group.Encode(), s.lockKey, s.token)
+}
+
+// UpdateGroupCAS saves group only if its modified index still equals
+// expectedVersion, returning ErrVersionConflict otherwise. Like UpdateGroup
+// it requires the topom lock: token must be the current lock's token, and
+// the write is rejected with ErrStaleToken once that lock has been lost, so
+// an admin tool or a second topom instance that does not hold the lock
+// cannot use it.
+func (s *TopomStore) UpdateGroupCAS(token int64, groupId int, group *models.Group, expectedVersion int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.AtomicPutGuarded(s.groupPath(groupId), group.Encode(), expectedVersion, s.lockKey, s.token)
+}
+
+func (s *TopomStore) RemoveGroup(token int64, groupId int) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkToken(token); err != nil {
+		return err
+	}
+
+	return s.store.DeleteGuarded(s.groupPath(groupId), s.lockKey, s.token)
+}
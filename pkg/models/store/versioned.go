@@ -0,0 +1,26 @@
+package store
+
+import "github.com/wandoulabs/codis/pkg/models"
+
+// VersionedSlotMapping pairs a decoded slot with the store's modified index
+// (the znode version on ZooKeeper) it was read at, so a caller doing a read-modify-write cycle can pass that
+// version back to SaveSlotMappingCAS.
+type VersionedSlotMapping struct {
+	Slot    *models.SlotMapping
+	Version int64
+}
+
+// VersionedProxy pairs a decoded proxy with the store's modified index (the
+// znode version on ZooKeeper) it was read at.
+type VersionedProxy struct {
+	Proxy   *models.Proxy
+	Version int64
+}
+
+// VersionedGroup pairs a decoded group with the store's modified index (the
+// znode version on ZooKeeper) it was read at, so a caller doing a read-modify-write cycle can pass that version
+// back to UpdateGroupCAS.
+type VersionedGroup struct {
+	Group   *models.Group
+	Version int64
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/wandoulabs/codis/pkg/models"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// EventType classifies a change delivered on a Watch* channel.
+type EventType int
+
+const (
+	EventCreate EventType = iota
+	EventUpdate
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreate:
+		return "create"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+type SlotEvent struct {
+	Type    EventType
+	SlotId  int
+	Slot    *models.SlotMapping // nil when Type == EventDelete
+	Version int64
+}
+
+type ProxyEvent struct {
+	Type    EventType
+	ProxyId int
+	Proxy   *models.Proxy // nil when Type == EventDelete
+	Version int64
+}
+
+type GroupEvent struct {
+	Type    EventType
+	GroupId int
+	Group   *models.Group // nil when Type == EventDelete
+	Version int64
+}
+
+// WatchSlots streams create/update/delete events for every slot under this
+// cluster until ctx is cancelled, so a proxy can react to slot migrations in
+// real time instead of polling LoadSlotMapping.
+func (s *TopomStore) WatchSlots(ctx context.Context) (<-chan SlotEvent, error) {
+	ch := make(chan SlotEvent, 64)
+	stopped, err := watchChildren(ctx, s.store, s.slotBase(), func(path string, data []byte, version int64, removed, created bool) {
+		slotId, err := parseId(path, "slot-")
+		if err != nil {
+			log.Errorf("store: watch slots: %s", err)
+			return
+		}
+		if removed {
+			ch <- SlotEvent{Type: EventDelete, SlotId: slotId, Version: version}
+			return
+		}
+		slot := &models.SlotMapping{}
+		if err := slot.Decode(data); err != nil {
+			log.Errorf("store: watch slots: decode %s: %s", path, err)
+			return
+		}
+		typ := EventUpdate
+		if created {
+			typ = EventCreate
+		}
+		ch <- SlotEvent{Type: typ, SlotId: slotId, Slot: slot, Version: version}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-stopped
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// WatchProxies streams create/update/delete events for every proxy
+// registered under this cluster until ctx is cancelled.
+func (s *TopomStore) WatchProxies(ctx context.Context) (<-chan ProxyEvent, error) {
+	ch := make(chan ProxyEvent, 64)
+	stopped, err := watchChildren(ctx, s.store, s.proxyBase(), func(path string, data []byte, version int64, removed, created bool) {
+		proxyId, err := parseId(path, "proxy-")
+		if err != nil {
+			log.Errorf("store: watch proxies: %s", err)
+			return
+		}
+		if removed {
+			ch <- ProxyEvent{Type: EventDelete, ProxyId: proxyId, Version: version}
+			return
+		}
+		proxy := &models.Proxy{}
+		if err := proxy.Decode(data); err != nil {
+			log.Errorf("store: watch proxies: decode %s: %s", path, err)
+			return
+		}
+		typ := EventUpdate
+		if created {
+			typ = EventCreate
+		}
+		ch <- ProxyEvent{Type: typ, ProxyId: proxyId, Proxy: proxy, Version: version}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-stopped
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// WatchGroups streams create/update/delete events for every group under
+// this cluster until ctx is cancelled.
+func (s *TopomStore) WatchGroups(ctx context.Context) (<-chan GroupEvent, error) {
+	ch := make(chan GroupEvent, 64)
+	stopped, err := watchChildren(ctx, s.store, s.groupBase(), func(path string, data []byte, version int64, removed, created bool) {
+		groupId, err := parseId(path, "group-")
+		if err != nil {
+			log.Errorf("store: watch groups: %s", err)
+			return
+		}
+		if removed {
+			ch <- GroupEvent{Type: EventDelete, GroupId: groupId, Version: version}
+			return
+		}
+		group := &models.Group{}
+		if err := group.Decode(data); err != nil {
+			log.Errorf("store: watch groups: decode %s: %s", path, err)
+			return
+		}
+		typ := EventUpdate
+		if created {
+			typ = EventCreate
+		}
+		ch <- GroupEvent{Type: typ, GroupId: groupId, Group: group, Version: version}
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-stopped
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (s *TopomStore) slotBase() string {
+	return filepath.Join(s.prefix, "slots")
+}
+
+// parseId extracts the integer id from a child name like "proxy-0004" or
+// "proxy-12345". It parses everything after prefix rather than scanning a
+// fixed-width "%04d", since fmt.Sscanf's width is a maximum, not a minimum:
+// it would silently truncate ids >= 10000 (unbounded proxy/group counters,
+// unlike the 1024-bounded slot id) while still reporting err == nil.
+func parseId(path, prefix string) (int, error) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, prefix) {
+		return 0, fmt.Errorf("malformed path %q: missing prefix %q", path, prefix)
+	}
+	id, err := strconv.Atoi(name[len(prefix):])
+	if err != nil {
+		return 0, fmt.Errorf("malformed path %q: %s", path, err)
+	}
+	return id, nil
+}
+
+// watchChildren delivers every create/update/delete under base to handle,
+// re-arming the backend watch after each signal. Bursts of changes between
+// two signals collapse into a single List+Get diff pass instead of one
+// event per change. If the backend's watch channel closes — most commonly
+// a ZooKeeper session expiring — watchChildren reconnects by replaying a
+// full List and diffing it against the last-seen versions, so no
+// create/update/delete is missed across the gap.
+//
+// The returned stopped channel is closed once the watch loop gives up for
+// good, whether because ctx was cancelled or because re-arming the
+// backend's watch or replaying the List failed outright (e.g. the store
+// was closed) — callers
+// use it to close their own event channel rather than leave consumers
+// blocked on a channel that will never receive or close again.
+func watchChildren(ctx context.Context, s Store, base string, handle func(path string, data []byte, version int64, removed, created bool)) (<-chan struct{}, error) {
+	seen := make(map[string]int64)
+
+	diff := func() error {
+		paths, err := s.List(base)
+		if err != nil {
+			return err
+		}
+		live := make(map[string]bool, len(paths))
+		for _, path := range paths {
+			live[path] = true
+			data, version, err := s.Get(path)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				continue
+			}
+			v, ok := seen[path]
+			switch {
+			case !ok:
+				handle(path, data, version, false, true)
+			case v != version:
+				handle(path, data, version, false, false)
+			default:
+				continue
+			}
+			seen[path] = version
+		}
+		for path := range seen {
+			if !live[path] {
+				handle(path, nil, 0, true, false)
+				delete(seen, path)
+			}
+		}
+		return nil
+	}
+
+	if _, err := s.List(base); err != nil {
+		return nil, err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// The first pass runs here, not before returning: handle may block
+		// until the caller starts reading the events it delivers.
+		if err := diff(); err != nil {
+			return
+		}
+		for {
+			watch, err := s.Watch(base)
+			if err != nil {
+				return
+			}
+		drain:
+			for {
+				select {
+				case _, ok := <-watch:
+					if !ok {
+						break drain
+					}
+					diff()
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			default:
+				if err := diff(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return stopped, nil
+}
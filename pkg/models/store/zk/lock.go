@@ -0,0 +1,149 @@
+package zk
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+
+	"github.com/wandoulabs/codis/pkg/models/store"
+)
+
+var ErrLockAborted = errors.New("zk: lock aborted")
+
+const lockNodePrefix = "lock-"
+
+// locker implements the standard ZooKeeper fair-lock recipe: contenders
+// create a sequential ephemeral znode under base, the lowest sequence
+// number holds the lock, and everyone else watches only their immediate
+// predecessor to avoid the herd effect of watching the whole set.
+type locker struct {
+	conn  *zk.Conn
+	base  string
+	value []byte
+
+	nodePath string
+	seq      int64
+}
+
+func (s *Store) Lock(key string, value []byte, ttl time.Duration) (store.Locker, error) {
+	return &locker{conn: s.conn, base: filepath.Join(key, "locks"), value: value}, nil
+}
+
+func (l *locker) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	if err := mkdirAll(l.conn, l.base); err != nil {
+		return nil, err
+	}
+	path, err := l.conn.CreateProtectedEphemeralSequential(
+		filepath.Join(l.base, lockNodePrefix), l.value, defaultACL)
+	if err != nil {
+		return nil, err
+	}
+	l.nodePath = path
+	l.seq, err = parseSeq(path)
+	if err != nil {
+		return nil, err
+	}
+	// Every return below this point until the lock is actually granted must
+	// give up l.nodePath's place in the queue, or a transient error here
+	// would occupy that sequence slot for the rest of the process's life and
+	// block every contender queued behind it.
+	granted := false
+	defer func() {
+		if !granted {
+			l.conn.Delete(l.nodePath, -1)
+		}
+	}()
+
+	for {
+		children, _, err := l.conn.Children(l.base)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(children)
+
+		predecessor := ""
+		for _, name := range children {
+			seq, err := parseSeq(name)
+			if err != nil {
+				continue
+			}
+			if seq == l.seq {
+				continue
+			}
+			if seq < l.seq && (predecessor == "" || seq > mustSeq(predecessor)) {
+				predecessor = name
+			}
+		}
+		if predecessor == "" {
+			break // we hold the smallest sequence number: lock granted.
+		}
+
+		exists, _, events, err := l.conn.ExistsW(filepath.Join(l.base, predecessor))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		select {
+		case <-events:
+		case <-stopCh:
+			return nil, ErrLockAborted
+		}
+	}
+	granted = true
+
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		_, _, events, err := l.conn.GetW(l.nodePath)
+		if err != nil {
+			return
+		}
+		<-events
+	}()
+	return lost, nil
+}
+
+func (l *locker) Unlock() error {
+	if l.nodePath == "" {
+		return nil
+	}
+	err := l.conn.Delete(l.nodePath, -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+// Token returns the winning znode's sequence number as the fencing token.
+func (l *locker) Token() int64 {
+	return l.seq
+}
+
+// Key returns the path of the ephemeral lock node this locker holds: the
+// node's sequence number is baked into its name, so its mere existence
+// already proves the holder identified by Token() is still current.
+func (l *locker) Key() string {
+	return l.nodePath
+}
+
+func parseSeq(path string) (int64, error) {
+	name := filepath.Base(path)
+	i := strings.LastIndex(name, lockNodePrefix)
+	if i < 0 {
+		return 0, fmt.Errorf("zk: malformed lock node %q", name)
+	}
+	return strconv.ParseInt(name[i+len(lockNodePrefix):], 10, 64)
+}
+
+func mustSeq(name string) int64 {
+	seq, _ := parseSeq(name)
+	return seq
+}
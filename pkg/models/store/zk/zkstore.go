@@ -1,275 +1,224 @@
-package zkstore
+// Package zk implements store.Store on top of a ZooKeeper ensemble. Paths
+// map directly onto znodes; locks use ephemeral znodes and watches use
+// ZooKeeper's native one-shot watchers.
+package zk
 
 import (
-	"errors"
-	"fmt"
 	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/wandoulabs/codis/pkg/models"
-	"github.com/wandoulabs/codis/pkg/utils/log"
-)
+	"github.com/samuel/go-zookeeper/zk"
 
-var (
-	ErrClosedZkStore = errors.New("use of closed zkstore")
-	ErrAcquireAgain  = errors.New("acquire again")
-	ErrReleaseAgain  = errors.New("release again")
-	ErrNoProtection  = errors.New("operation without lock protection")
+	"github.com/wandoulabs/codis/pkg/models/store"
+	"github.com/wandoulabs/codis/pkg/utils/log"
 )
 
-type ZkStore struct {
-	sync.Mutex
+var defaultACL = zk.WorldACL(zk.PermAll)
 
-	client *ZkClient
-	prefix string
-
-	locked bool
+// Store is a store.Store backed by ZooKeeper.
+type Store struct {
+	mu     sync.Mutex
+	conn   *zk.Conn
 	closed bool
 }
 
-func NewStore(addr []string) (*ZkStore, error) {
-	client, err := NewClient(addr, time.Minute)
+// NewStore dials the given ZooKeeper ensemble and returns a store.Store
+// backed by it.
+func NewStore(endpoints []string) (store.Store, error) {
+	conn, events, err := zk.Connect(endpoints, time.Minute)
 	if err != nil {
 		return nil, err
 	}
-	client.SetLogger(func(format string, v ...interface{}) {
-		log.Infof(format, v...)
-	})
-	return &ZkStore{
-		client: client,
-	}, nil
+	conn.SetLogger(zkLogger{})
+	go func() {
+		for e := range events {
+			log.Debugf("zk: session event: %+v", e)
+		}
+	}()
+	return &Store{conn: conn}, nil
 }
 
-func (s *ZkStore) Close() error {
-	s.Lock()
-	defer s.Unlock()
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, v ...interface{}) {
+	log.Infof(format, v...)
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.closed {
 		return nil
 	}
 	s.closed = true
-
-	s.client.Close()
+	s.conn.Close()
 	return nil
 }
 
-func (s *ZkStore) lockPath() string {
-	return filepath.Join(s.prefix, "topom")
-}
-
-func (s *ZkStore) slotPath(slotId int) string {
-	return filepath.Join(s.prefix, "slots", fmt.Sprintf("slot-%04d", slotId))
-}
-
-func (s *ZkStore) proxyBase() string {
-	return filepath.Join(s.prefix, "proxy")
-}
-
-func (s *ZkStore) proxyPath(proxyId int) string {
-	return filepath.Join(s.prefix, "proxy", fmt.Sprintf("proxy-%4d", proxyId))
-}
-
-func (s *ZkStore) groupBase() string {
-	return filepath.Join(s.prefix, "group")
-}
-
-func (s *ZkStore) groupPath(groupId int) string {
-	return filepath.Join(s.prefix, "group", fmt.Sprintf("group-%04d", groupId))
-}
-
-func (s *ZkStore) Acquire(name string, topom *models.Topom) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
-	}
-	if s.locked {
-		return ErrAcquireAgain
+func (s *Store) Get(path string) ([]byte, int64, error) {
+	b, stat, err := s.conn.Get(path)
+	if err == zk.ErrNoNode {
+		return nil, 0, nil
 	}
-	s.prefix = filepath.Join("/zk/codis2", name)
-
-	if err := s.client.Create(s.lockPath(), topom.Encode()); err != nil {
-		return err
+	if err != nil {
+		return nil, 0, err
 	}
-	s.locked = true
-	return nil
+	return b, int64(stat.Version), nil
 }
 
-func (s *ZkStore) Release() error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
+func (s *Store) Put(path string, value []byte) error {
+	if err := mkdirAll(s.conn, filepath.Dir(path)); err != nil {
+		return err
 	}
-	if !s.locked {
-		return ErrReleaseAgain
+	_, err := s.conn.Create(path, value, 0, defaultACL)
+	if err == zk.ErrNodeExists {
+		_, err = s.conn.Set(path, value, -1)
 	}
+	return err
+}
 
-	if err := s.client.Delete(s.lockPath()); err != nil {
-		return err
+func (s *Store) Delete(path string) error {
+	err := s.conn.Delete(path, -1)
+	if err == zk.ErrNoNode {
+		return nil
 	}
-	s.locked = false
-	return nil
+	return err
 }
 
-func (s *ZkStore) LoadSlotMapping(slotId int) (*models.SlotMapping, error) {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return nil, ErrClosedZkStore
-	}
-	if !s.locked {
-		return nil, ErrNoProtection
+func (s *Store) List(path string) ([]string, error) {
+	children, _, err := s.conn.Children(path)
+	if err == zk.ErrNoNode {
+		return nil, nil
 	}
-
-	b, err := s.client.LoadData(s.slotPath(slotId))
 	if err != nil {
 		return nil, err
 	}
-	if b != nil {
-		slot := &models.SlotMapping{}
-		if err := slot.Decode(b); err != nil {
-			return nil, err
-		}
-		return slot, nil
+	paths := make([]string, len(children))
+	for i, name := range children {
+		paths[i] = filepath.Join(path, name)
 	}
-	return nil, nil
+	return paths, nil
 }
 
-func (s *ZkStore) SaveSlotMapping(slotId int, slot *models.SlotMapping) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
-	}
-	if !s.locked {
-		return ErrNoProtection
+func (s *Store) AtomicPut(path string, value []byte, expectedIndex int64) error {
+	_, err := s.conn.Set(path, value, int32(expectedIndex))
+	if err == zk.ErrBadVersion {
+		return store.ErrVersionConflict
 	}
-
-	return s.client.Update(s.slotPath(slotId), slot.Encode())
+	return err
 }
 
-func (s *ZkStore) ListProxy() ([]*models.Proxy, error) {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return nil, ErrClosedZkStore
-	}
-	if !s.locked {
-		return nil, ErrNoProtection
-	}
-
-	files, err := s.client.ListFile(s.proxyBase())
-	if err != nil {
-		return nil, err
+// PutGuarded writes value to path in the same ZooKeeper transaction as a
+// check that guardPath — the lock node backing a fencing token — still
+// exists. guardVersion is ignored: the node's sequence number is already
+// baked into guardPath itself, so its existence alone proves the token is
+// still current (see zk.locker.Key).
+func (s *Store) PutGuarded(path string, value []byte, guardPath string, guardVersion int64) error {
+	if err := mkdirAll(s.conn, filepath.Dir(path)); err != nil {
+		return err
 	}
-
-	var plist []*models.Proxy
-	for _, file := range files {
-		b, err := s.client.LoadData(file)
-		if err != nil {
-			return nil, err
-		}
-		p := &models.Proxy{}
-		if err := p.Decode(b); err != nil {
-			return nil, err
+	check := &zk.CheckVersionRequest{Path: guardPath, Version: -1}
+	if _, err := s.conn.Multi(check, &zk.CreateRequest{Path: path, Data: value, Acl: defaultACL}); err != nil {
+		if err == zk.ErrNodeExists {
+			_, err = s.conn.Multi(check, &zk.SetDataRequest{Path: path, Data: value, Version: -1})
 		}
-		plist = append(plist, p)
+		return mapGuardErr(err)
 	}
-	return plist, nil
+	return nil
 }
 
-func (s *ZkStore) CreateProxy(proxyId int, proxy *models.Proxy) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
+// DeleteGuarded is PutGuarded's counterpart for Delete. zk.ErrNoNode is
+// ambiguous between the two ops in the transaction — the guard (lock) node
+// being gone versus path already being gone — and those mean opposite
+// things (stale token vs. legitimate idempotent no-op), so the per-op
+// responses have to be inspected rather than collapsing on the overall
+// error.
+func (s *Store) DeleteGuarded(path string, guardPath string, guardVersion int64) error {
+	check := &zk.CheckVersionRequest{Path: guardPath, Version: -1}
+	del := &zk.DeleteRequest{Path: path, Version: -1}
+	resps, err := s.conn.Multi(check, del)
+	if err == nil {
+		return nil
 	}
-	if !s.locked {
-		return ErrNoProtection
+	if len(resps) > 0 && resps[0].Error != nil {
+		return store.ErrStaleToken
 	}
-
-	return s.client.Create(s.proxyPath(proxyId), proxy.Encode())
+	if len(resps) > 1 && resps[1].Error == zk.ErrNoNode {
+		return nil
+	}
+	return err
 }
 
-func (s *ZkStore) RemoveProxy(proxyId int) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
+// AtomicPutGuarded combines AtomicPut's version check on path with
+// PutGuarded's check on guardPath, in a single transaction.
+func (s *Store) AtomicPutGuarded(path string, value []byte, expectedIndex int64, guardPath string, guardVersion int64) error {
+	check := &zk.CheckVersionRequest{Path: guardPath, Version: -1}
+	set := &zk.SetDataRequest{Path: path, Data: value, Version: int32(expectedIndex)}
+	resps, err := s.conn.Multi(check, set)
+	if err == zk.ErrBadVersion {
+		return store.ErrVersionConflict
 	}
-	if !s.locked {
-		return ErrNoProtection
+	if err != nil && len(resps) > 0 && resps[0].Error == nil {
+		return err // the guard held; path itself is missing
 	}
-
-	return s.client.Delete(s.proxyPath(proxyId))
+	return mapGuardErr(err)
 }
 
-func (s *ZkStore) ListGroup() ([]*models.Group, error) {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return nil, ErrClosedZkStore
-	}
-	if !s.locked {
-		return nil, ErrNoProtection
+// mapGuardErr turns the lock-node-gone case of a guarded transaction into
+// store.ErrStaleToken; every other error (including nil) passes through.
+func mapGuardErr(err error) error {
+	if err == zk.ErrNoNode {
+		return store.ErrStaleToken
 	}
+	return err
+}
 
-	files, err := s.client.ListFile(s.groupBase())
-	if err != nil {
-		return nil, err
-	}
+// Watch signals when a child of path is created or deleted, or path itself
+// is deleted. It uses ChildrenW only, so a new value written to an existing
+// child is not signalled.
+func (s *Store) Watch(path string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	go s.watch(path, ch)
+	return ch, nil
+}
 
-	var glist []*models.Group
-	for _, file := range files {
-		b, err := s.client.LoadData(file)
+func (s *Store) watch(path string, ch chan<- struct{}) {
+	defer close(ch)
+	for {
+		_, _, events, err := s.conn.ChildrenW(path)
 		if err != nil {
-			return nil, err
+			return
+		}
+		if e := <-events; e.Err != nil {
+			return
 		}
-		g := &models.Group{}
-		if err := g.Decode(b); err != nil {
-			return nil, err
+		select {
+		case ch <- struct{}{}:
+		default:
 		}
-		glist = append(glist, g)
 	}
-	return glist, nil
 }
 
-func (s *ZkStore) CreateGroup(groupId int, group *models.Group) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
-	}
-	if !s.locked {
-		return ErrNoProtection
+// mkdirAll creates path and its ancestors as empty znodes if they do not
+// already exist, mirroring the directories libkv backends create implicitly.
+func mkdirAll(conn *zk.Conn, path string) error {
+	if path == "/" || path == "." {
+		return nil
 	}
-
-	return s.client.Create(s.groupPath(groupId), group.Encode())
-}
-
-func (s *ZkStore) UpdateGroup(groupId int, group *models.Group) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
+	exists, _, err := conn.Exists(path)
+	if err != nil {
+		return err
 	}
-	if !s.locked {
-		return ErrNoProtection
+	if exists {
+		return nil
 	}
-
-	return s.client.Update(s.groupPath(groupId), group.Encode())
-}
-
-func (s *ZkStore) RemoveGroup(groupId int) error {
-	s.Lock()
-	defer s.Unlock()
-	if s.closed {
-		return ErrClosedZkStore
+	if err := mkdirAll(conn, filepath.Dir(path)); err != nil {
+		return err
 	}
-	if !s.locked {
-		return ErrNoProtection
+	_, err = conn.Create(path, nil, 0, defaultACL)
+	if err != nil && err != zk.ErrNodeExists {
+		return err
 	}
-
-	return s.client.Delete(s.groupPath(groupId))
+	return nil
 }